@@ -1,10 +1,10 @@
 package main
 
 import (
+	"context"
 	"encoding/csv"
 	"fmt"
 	"github.com/nu7hatch/gouuid"
-	"github.com/vmihailenco/msgpack"
 	"labix.org/v2/mgo"
 	"os"
 	"strconv"
@@ -43,10 +43,19 @@ type AnalyticsHandler interface {
 }
 
 // Purger is an interface that will define how the in-memory store will be purged
-// of analytics data to prevent it growing too large
+// of analytics data to prevent it growing too large. StartPurgeLoop must
+// return promptly once ctx is cancelled so RunPurgers can coordinate a final
+// flush during shutdown.
 type Purger interface {
 	PurgeCache()
-	StartPurgeLoop(int)
+	StartPurgeLoop(ctx context.Context, interval time.Duration)
+}
+
+// Closer is implemented by purgers that hold on to an external resource (an
+// open file, a database session) that must be released during shutdown,
+// after the final PurgeCache call has completed.
+type Closer interface {
+	Close() error
 }
 
 // RedisAnalyticsHandler implements AnalyticsHandler and will record analytics
@@ -54,11 +63,48 @@ type Purger interface {
 type RedisAnalyticsHandler struct {
 	Store *RedisStorageManager
 	Clean Purger
+
+	// Codec and Compression select how RecordHit encodes records before
+	// they're written to Redis. They default to MsgpackCodec{} and
+	// codecCompressionNone (i.e. the original behaviour) when left unset.
+	Codec       RecordCodec
+	Compression byte
+
+	// PathResolver, if set, is used to collapse a request path down to its
+	// registered route template before normalization runs.
+	PathResolver RoutePatternResolver
+}
+
+// NewRedisAnalyticsHandler builds a RedisAnalyticsHandler whose Codec and
+// Compression are selected by config.AnalyticsConfig.Serializer (e.g.
+// "protobuf+lz4", as described by the analytics_config.serializer setting).
+// An empty or invalid Serializer falls back to msgpack with no compression,
+// matching RecordHit's original behaviour.
+func NewRedisAnalyticsHandler(store *RedisStorageManager) *RedisAnalyticsHandler {
+	codec, compression, err := NewRecordCodecFromConfig(config.AnalyticsConfig.Serializer)
+	if err != nil {
+		log.Error("Invalid analytics_config.serializer, falling back to msgpack:")
+		log.Error(err)
+		codec, compression = MsgpackCodec{}, codecCompressionNone
+	}
+
+	return &RedisAnalyticsHandler{
+		Store:       store,
+		Codec:       codec,
+		Compression: compression,
+	}
 }
 
 // RecordHit will store an AnalyticsRecord in Redis
 func (r RedisAnalyticsHandler) RecordHit(thisRecord AnalyticsRecord) error {
-	encoded, err := msgpack.Marshal(thisRecord)
+	thisRecord = normalizeRecord(thisRecord, normalizeConfigFor(thisRecord.ApiId), r.PathResolver)
+
+	codec := r.Codec
+	if codec == nil {
+		codec = MsgpackCodec{}
+	}
+
+	encoded, err := EncodeRecord(thisRecord, codec, r.Compression)
 	u5, _ := uuid.NewV4()
 
 	keyName := fmt.Sprintf("%d%d%d%d-%s", thisRecord.Year, thisRecord.Month, thisRecord.Day, thisRecord.Hour, u5.String())
@@ -77,70 +123,138 @@ func (r RedisAnalyticsHandler) RecordHit(thisRecord AnalyticsRecord) error {
 // CSVPurger purges the in-memory analytics store to a CSV file as defined in the Config object
 type CSVPurger struct {
 	Store *RedisStorageManager
+
+	currentFile *os.File
 }
 
-// StartPurgeLoop is used as a goroutine to ensure that the cache is purged
-// of analytics data (assuring size is small).
-func (c CSVPurger) StartPurgeLoop(nextCount int) {
-	time.Sleep(time.Duration(nextCount) * time.Second)
-	c.PurgeCache()
-	c.StartPurgeLoop(nextCount)
+// StartPurgeLoop runs PurgeCache every interval until ctx is cancelled.
+func (c *CSVPurger) StartPurgeLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.PurgeCache()
+		}
+	}
 }
 
 // PurgeCache Will pull all the analytics data from the
 // cache and drop it to a storage engine, in this case a CSV file
-func (c CSVPurger) PurgeCache() {
+func (c *CSVPurger) PurgeCache() {
+	KeyValueMap := c.Store.GetKeysAndValues()
+	if len(KeyValueMap) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(KeyValueMap))
+	records := make([]AnalyticsRecord, 0, len(KeyValueMap))
+
+	for k, v := range KeyValueMap {
+		keys = append(keys, k)
+		decoded, err := DecodeRecord([]byte(v))
+		if err != nil {
+			log.Error("Couldn't decode analytics data:")
+			log.Error(err)
+			continue
+		}
+		records = append(records, decoded)
+	}
+
+	f, err := createCSVFile(config.AnalyticsConfig.CSVDir, records)
+	if err != nil {
+		log.Error("Failed to write CSV batch:")
+		log.Error(err)
+		return
+	}
+
+	if c.currentFile != nil {
+		c.currentFile.Close()
+	}
+	c.currentFile = f
+
+	c.Store.DeleteKeys(keys)
+}
+
+// Close fsyncs and closes the most recently written CSV file, so buffered
+// writes aren't lost when Tyk shuts down between purge ticks.
+func (c *CSVPurger) Close() error {
+	if c.currentFile == nil {
+		return nil
+	}
+
+	if err := c.currentFile.Sync(); err != nil {
+		c.currentFile.Close()
+		return err
+	}
+
+	return c.currentFile.Close()
+}
+
+// writeCSVFile writes records to a new timestamped CSV file under dir and
+// closes it.
+func writeCSVFile(dir string, records []AnalyticsRecord) error {
+	f, err := createCSVFile(dir, records)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// createCSVFile writes records to a new timestamped CSV file under dir,
+// creating dir if it doesn't already exist, and returns the open file handle
+// without closing it so callers can keep it around (e.g. to fsync on
+// shutdown).
+func createCSVFile(dir string, records []AnalyticsRecord) (*os.File, error) {
 	curtime := time.Now()
-	fname := fmt.Sprintf("%s%d-%s-%d-%d-%d.csv", config.AnalyticsConfig.CSVDir, curtime.Year(), curtime.Month().String(), curtime.Day(), curtime.Hour(), curtime.Minute())
+	fname := fmt.Sprintf("%s%d-%s-%d-%d-%d.csv", dir, curtime.Year(), curtime.Month().String(), curtime.Day(), curtime.Hour(), curtime.Minute())
 
-	ferr := os.MkdirAll(config.AnalyticsConfig.CSVDir, 0777)
-	if ferr != nil {
-		log.Error(ferr)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
 	}
-	outfile, _ := os.Create(fname)
-	defer outfile.Close()
+
+	outfile, err := os.Create(fname)
+	if err != nil {
+		return nil, err
+	}
+
 	writer := csv.NewWriter(outfile)
 
 	var headers = []string{"METHOD", "PATH", "SIZE", "UA", "DAY", "MONTH", "YEAR", "HOUR", "RESPONSE", "APINAME", "APIVERSION"}
+	if err := writer.Write(headers); err != nil {
+		outfile.Close()
+		return nil, err
+	}
 
-	err := writer.Write(headers)
-	if err != nil {
-		log.Error("Failed to write file headers!")
-		log.Error(err)
-	} else {
-		KeyValueMap := c.Store.GetKeysAndValues()
-		keys := []string{}
-
-		for k, v := range KeyValueMap {
-			keys = append(keys, k)
-			decoded := AnalyticsRecord{}
-			err := msgpack.Unmarshal([]byte(v), &decoded)
-			if err != nil {
-				log.Error("Couldn't unmarshal analytics data:")
-				log.Error(err)
-			} else {
-				toWrite := []string{
-					decoded.Method,
-					decoded.Path,
-					strconv.FormatInt(decoded.ContentLength, 10),
-					decoded.UserAgent,
-					strconv.Itoa(decoded.Day),
-					decoded.Month.String(),
-					strconv.Itoa(decoded.Year),
-					strconv.Itoa(decoded.Hour),
-					strconv.Itoa(decoded.ResponseCode),
-					decoded.APIName,
-					decoded.APIVersion}
-				err := writer.Write(toWrite)
-				if err != nil {
-					log.Error("File write failed!")
-					log.Error(err)
-				}
-			}
+	for _, decoded := range records {
+		toWrite := []string{
+			decoded.Method,
+			decoded.Path,
+			strconv.FormatInt(decoded.ContentLength, 10),
+			decoded.UserAgent,
+			strconv.Itoa(decoded.Day),
+			decoded.Month.String(),
+			strconv.Itoa(decoded.Year),
+			strconv.Itoa(decoded.Hour),
+			strconv.Itoa(decoded.ResponseCode),
+			decoded.APIName,
+			decoded.APIVersion}
+		if err := writer.Write(toWrite); err != nil {
+			outfile.Close()
+			return nil, err
 		}
-		writer.Flush()
-		c.Store.DeleteKeys(keys)
 	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		outfile.Close()
+		return nil, err
+	}
+
+	return outfile, nil
 }
 
 // MongoPurger will purge analytics data into a Mongo database, requires that the Mongo DB string is specified
@@ -160,12 +274,28 @@ func (m *MongoPurger) Connect() {
 	}
 }
 
-// StartPurgeLoop starts the loop that will be started as a goroutine and pull data out of the in-memory
-// store and into MongoDB
-func (m MongoPurger) StartPurgeLoop(nextCount int) {
-	time.Sleep(time.Duration(nextCount) * time.Second)
-	m.PurgeCache()
-	m.StartPurgeLoop(nextCount)
+// StartPurgeLoop runs PurgeCache every interval until ctx is cancelled.
+func (m *MongoPurger) StartPurgeLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.PurgeCache()
+		}
+	}
+}
+
+// Close closes the Mongo session, if one was ever established.
+func (m *MongoPurger) Close() error {
+	if m.dbSession == nil {
+		return nil
+	}
+	m.dbSession.Close()
+	return nil
 }
 
 // PurgeCache will pull the data from the in-memory store and drop it into the specified MongoDB collection
@@ -175,35 +305,45 @@ func (m *MongoPurger) PurgeCache() {
 		m.Connect()
 		m.PurgeCache()
 	} else {
-		analyticsCollection := m.dbSession.DB("").C(config.AnalyticsConfig.MongoCollection)
 		KeyValueMap := m.Store.GetKeysAndValues()
 
 		if len(KeyValueMap) > 0 {
-			keys := make([]interface{}, len(KeyValueMap), len(KeyValueMap))
-			keyNames := make([]string, len(KeyValueMap), len(KeyValueMap))
+			keys := make([]string, 0, len(KeyValueMap))
+			records := make([]AnalyticsRecord, 0, len(KeyValueMap))
 
-			i := 0
 			for k, v := range KeyValueMap {
-				keyNames[i] = k
-				decoded := AnalyticsRecord{}
-				err := msgpack.Unmarshal([]byte(v), &decoded)
+				keys = append(keys, k)
+				decoded, err := DecodeRecord([]byte(v))
 				if err != nil {
-					log.Error("Couldn't unmarshal analytics data:")
+					log.Error("Couldn't decode analytics data:")
 					log.Error(err)
-				} else {
-					keys[i] = interface{}(decoded)
+					continue
 				}
-				i += 1
+				records = append(records, decoded)
 			}
 
-			err := analyticsCollection.Insert(keys...)
-			if err != nil {
+			if err := insertMongoRecords(m.dbSession, config.AnalyticsConfig.MongoCollection, records); err != nil {
 				log.Error("Problem inserting to mongo collection")
 				log.Error(err)
-			} else {
-				m.Store.DeleteKeys(keyNames)
+				return
 			}
+
+			m.Store.DeleteKeys(keys)
 		}
 	}
 
 }
+
+// insertMongoRecords inserts records into the named collection on session.
+func insertMongoRecords(session *mgo.Session, collection string, records []AnalyticsRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	docs := make([]interface{}, len(records))
+	for i, r := range records {
+		docs[i] = interface{}(r)
+	}
+
+	return session.DB("").C(collection).Insert(docs...)
+}
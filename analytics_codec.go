@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/TykTechnologies/tyk/analyticspb"
+	"github.com/golang/protobuf/proto"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Every value RecordHit writes to Redis is prefixed with a single magic byte
+// so purgers can tell how it was encoded, even for records written by a
+// previous version of Tyk before the serializer was changed. The low nibble
+// identifies the codec, the high nibble identifies the compression wrapper
+// (codecCompressionNone if the value isn't compressed).
+const (
+	codecMsgpack  byte = 0x01
+	codecProtobuf byte = 0x02
+
+	codecCompressionNone byte = 0x00
+	codecCompressionLZ4  byte = 0x10
+	codecCompressionZstd byte = 0x20
+)
+
+// RecordCodec encodes and decodes AnalyticsRecord values for storage. It does
+// not handle the magic byte prefix itself; EncodeRecord/DecodeRecord own
+// that so every codec benefits from auto-detection uniformly.
+type RecordCodec interface {
+	magic() byte
+	marshal(AnalyticsRecord) ([]byte, error)
+	unmarshal([]byte) (AnalyticsRecord, error)
+}
+
+// MsgpackCodec is the original encoding used by RecordHit.
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) magic() byte { return codecMsgpack }
+
+func (MsgpackCodec) marshal(r AnalyticsRecord) ([]byte, error) {
+	return msgpack.Marshal(r)
+}
+
+func (MsgpackCodec) unmarshal(data []byte) (AnalyticsRecord, error) {
+	var r AnalyticsRecord
+	err := msgpack.Unmarshal(data, &r)
+	return r, err
+}
+
+// ProtobufCodec encodes AnalyticsRecord using the generated
+// analyticspb.AnalyticsRecord message, giving a smaller and forward-stable
+// wire format compared to msgpack.
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) magic() byte { return codecProtobuf }
+
+func (ProtobufCodec) marshal(r AnalyticsRecord) ([]byte, error) {
+	return proto.Marshal(&analyticspb.AnalyticsRecord{
+		Method:        r.Method,
+		Path:          r.Path,
+		ContentLength: r.ContentLength,
+		UserAgent:     r.UserAgent,
+		Day:           int32(r.Day),
+		Month:         int32(r.Month),
+		Year:          int32(r.Year),
+		Hour:          int32(r.Hour),
+		ResponseCode:  int32(r.ResponseCode),
+		ApiKey:        r.APIKey,
+		TimeStampUnix: r.TimeStamp.UnixNano(),
+		ApiVersion:    r.APIVersion,
+		ApiName:       r.APIName,
+		ApiId:         r.ApiId,
+		OrgId:         r.OrgId,
+	})
+}
+
+func (ProtobufCodec) unmarshal(data []byte) (AnalyticsRecord, error) {
+	var pb analyticspb.AnalyticsRecord
+	if err := proto.Unmarshal(data, &pb); err != nil {
+		return AnalyticsRecord{}, err
+	}
+
+	return AnalyticsRecord{
+		Method:        pb.Method,
+		Path:          pb.Path,
+		ContentLength: pb.ContentLength,
+		UserAgent:     pb.UserAgent,
+		Day:           int(pb.Day),
+		Month:         time.Month(pb.Month),
+		Year:          int(pb.Year),
+		Hour:          int(pb.Hour),
+		ResponseCode:  int(pb.ResponseCode),
+		APIKey:        pb.ApiKey,
+		TimeStamp:     time.Unix(0, pb.TimeStampUnix),
+		APIVersion:    pb.ApiVersion,
+		APIName:       pb.ApiName,
+		ApiId:         pb.ApiId,
+		OrgId:         pb.OrgId,
+	}, nil
+}
+
+// compress/decompress apply the LZ4 or zstd wrapper named by b (one of the
+// codecCompression* constants).
+func compress(b byte, data []byte) ([]byte, error) {
+	switch b {
+	case codecCompressionLZ4:
+		var buf bytes.Buffer
+		w := lz4.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case codecCompressionZstd:
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer enc.Close()
+		return enc.EncodeAll(data, nil), nil
+	default:
+		return data, nil
+	}
+}
+
+func decompress(b byte, data []byte) ([]byte, error) {
+	switch b {
+	case codecCompressionLZ4:
+		r := lz4.NewReader(bytes.NewReader(data))
+		return ioutil.ReadAll(r)
+	case codecCompressionZstd:
+		dec, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		return dec.DecodeAll(data, nil)
+	default:
+		return data, nil
+	}
+}
+
+// EncodeRecord marshals r with codec, applies compression, and prepends the
+// one-byte magic/version header that DecodeRecord uses to reverse the
+// process.
+func EncodeRecord(r AnalyticsRecord, codec RecordCodec, compression byte) ([]byte, error) {
+	marshaled, err := codec.marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := compress(compression, marshaled)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 1, len(payload)+1)
+	out[0] = codec.magic() | compression
+	out = append(out, payload...)
+	return out, nil
+}
+
+// DecodeRecord reads the magic byte prefixed to data, selects the matching
+// codec and compression wrapper, and decodes the remainder back into an
+// AnalyticsRecord. Records written before this magic-byte scheme existed are
+// raw msgpack with no header at all, so any first byte that doesn't parse as
+// one of our known (codec, compression) combinations is treated as such a
+// legacy value and decoded whole, header byte included. That's what lets
+// records drained after an upgrade still decode correctly.
+func DecodeRecord(data []byte) (AnalyticsRecord, error) {
+	if len(data) == 0 {
+		return AnalyticsRecord{}, fmt.Errorf("analytics: empty record")
+	}
+
+	if codec, compression, ok := parseHeader(data[0]); ok {
+		payload, err := decompress(compression, data[1:])
+		if err != nil {
+			return AnalyticsRecord{}, err
+		}
+		return codec.unmarshal(payload)
+	}
+
+	return MsgpackCodec{}.unmarshal(data)
+}
+
+// parseHeader splits header into a known codec and compression wrapper. ok
+// is false when header doesn't match any combination EncodeRecord ever
+// produces, which is how DecodeRecord tells a pre-magic-byte legacy record
+// apart from one of ours.
+func parseHeader(header byte) (RecordCodec, byte, bool) {
+	compression := header & 0xF0
+	switch compression {
+	case codecCompressionNone, codecCompressionLZ4, codecCompressionZstd:
+	default:
+		return nil, 0, false
+	}
+
+	switch header & 0x0F {
+	case codecMsgpack:
+		return MsgpackCodec{}, compression, true
+	case codecProtobuf:
+		return ProtobufCodec{}, compression, true
+	default:
+		return nil, 0, false
+	}
+}
+
+// NewRecordCodecFromConfig parses a serializer name such as "msgpack",
+// "protobuf", "msgpack+lz4" or "protobuf+zstd" (as configured via
+// analytics_config.serializer) into a RecordCodec and a compression byte.
+func NewRecordCodecFromConfig(serializer string) (RecordCodec, byte, error) {
+	if serializer == "" {
+		return MsgpackCodec{}, codecCompressionNone, nil
+	}
+
+	parts := strings.SplitN(serializer, "+", 2)
+
+	var codec RecordCodec
+	switch strings.ToLower(parts[0]) {
+	case "msgpack":
+		codec = MsgpackCodec{}
+	case "protobuf":
+		codec = ProtobufCodec{}
+	default:
+		return nil, 0, fmt.Errorf("analytics: unknown serializer %q", parts[0])
+	}
+
+	compression := codecCompressionNone
+	if len(parts) == 2 {
+		switch strings.ToLower(parts[1]) {
+		case "lz4":
+			compression = codecCompressionLZ4
+		case "zstd":
+			compression = codecCompressionZstd
+		default:
+			return nil, 0, fmt.Errorf("analytics: unknown compression %q", parts[1])
+		}
+	}
+
+	return codec, compression, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+func testRecord() AnalyticsRecord {
+	return AnalyticsRecord{
+		Method:        "GET",
+		Path:          "/users/42",
+		ContentLength: 1024,
+		UserAgent:     "curl/7.64.1",
+		Day:           29,
+		Month:         time.July,
+		Year:          2026,
+		Hour:          12,
+		ResponseCode:  200,
+		APIKey:        "abc123",
+		TimeStamp:     time.Unix(1700000000, 0),
+		APIVersion:    "v1",
+		APIName:       "My API",
+		ApiId:         "api-1",
+		OrgId:         "org-1",
+	}
+}
+
+// TestDecodeRecord_LegacyMsgpack proves that a value written before the
+// RecordCodec magic-byte scheme existed (a raw msgpack.Marshal of
+// AnalyticsRecord, with no header byte) still decodes correctly.
+func TestDecodeRecord_LegacyMsgpack(t *testing.T) {
+	want := testRecord()
+
+	legacy, err := msgpack.Marshal(want)
+	if err != nil {
+		t.Fatalf("msgpack.Marshal: %v", err)
+	}
+
+	got, err := DecodeRecord(legacy)
+	if err != nil {
+		t.Fatalf("DecodeRecord on legacy blob: %v", err)
+	}
+
+	if got.Path != want.Path || got.APIKey != want.APIKey || got.ResponseCode != want.ResponseCode {
+		t.Fatalf("decoded legacy record mismatch: got %+v, want %+v", got, want)
+	}
+}
+
+func TestEncodeDecodeRecord_RoundTrip(t *testing.T) {
+	want := testRecord()
+
+	combos := []struct {
+		name        string
+		codec       RecordCodec
+		compression byte
+	}{
+		{"msgpack", MsgpackCodec{}, codecCompressionNone},
+		{"msgpack+lz4", MsgpackCodec{}, codecCompressionLZ4},
+		{"msgpack+zstd", MsgpackCodec{}, codecCompressionZstd},
+		{"protobuf", ProtobufCodec{}, codecCompressionNone},
+		{"protobuf+lz4", ProtobufCodec{}, codecCompressionLZ4},
+		{"protobuf+zstd", ProtobufCodec{}, codecCompressionZstd},
+	}
+
+	for _, c := range combos {
+		t.Run(c.name, func(t *testing.T) {
+			encoded, err := EncodeRecord(want, c.codec, c.compression)
+			if err != nil {
+				t.Fatalf("EncodeRecord: %v", err)
+			}
+
+			got, err := DecodeRecord(encoded)
+			if err != nil {
+				t.Fatalf("DecodeRecord: %v", err)
+			}
+
+			if got.Path != want.Path || got.APIKey != want.APIKey || got.ResponseCode != want.ResponseCode {
+				t.Fatalf("round trip mismatch: got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+// TestNewRedisAnalyticsHandler_SelectsCodecFromConfig proves that
+// analytics_config.serializer actually drives which RecordCodec and
+// compression RecordHit uses, rather than RecordHit always defaulting to
+// msgpack/none regardless of config.
+func TestNewRedisAnalyticsHandler_SelectsCodecFromConfig(t *testing.T) {
+	originalSerializer := config.AnalyticsConfig.Serializer
+	defer func() { config.AnalyticsConfig.Serializer = originalSerializer }()
+
+	config.AnalyticsConfig.Serializer = "protobuf+lz4"
+	handler := NewRedisAnalyticsHandler(nil)
+
+	if _, ok := handler.Codec.(ProtobufCodec); !ok {
+		t.Fatalf("expected ProtobufCodec, got %T", handler.Codec)
+	}
+	if handler.Compression != codecCompressionLZ4 {
+		t.Fatalf("expected codecCompressionLZ4, got 0x%02x", handler.Compression)
+	}
+
+	config.AnalyticsConfig.Serializer = "not-a-real-serializer"
+	handler = NewRedisAnalyticsHandler(nil)
+
+	if _, ok := handler.Codec.(MsgpackCodec); !ok {
+		t.Fatalf("expected fallback to MsgpackCodec on invalid serializer, got %T", handler.Codec)
+	}
+	if handler.Compression != codecCompressionNone {
+		t.Fatalf("expected fallback to codecCompressionNone, got 0x%02x", handler.Compression)
+	}
+}
+
+// BenchmarkCodecCompression reports encode time and output size for every
+// codec/compression combination, so the CPU-vs-Redis-memory tradeoff from
+// the request is measurable rather than asserted.
+func BenchmarkCodecCompression(b *testing.B) {
+	record := testRecord()
+
+	combos := []struct {
+		name        string
+		codec       RecordCodec
+		compression byte
+	}{
+		{"msgpack/none", MsgpackCodec{}, codecCompressionNone},
+		{"msgpack/lz4", MsgpackCodec{}, codecCompressionLZ4},
+		{"msgpack/zstd", MsgpackCodec{}, codecCompressionZstd},
+		{"protobuf/none", ProtobufCodec{}, codecCompressionNone},
+		{"protobuf/lz4", ProtobufCodec{}, codecCompressionLZ4},
+		{"protobuf/zstd", ProtobufCodec{}, codecCompressionZstd},
+	}
+
+	for _, c := range combos {
+		c := c
+		b.Run(c.name, func(b *testing.B) {
+			var encoded []byte
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var err error
+				encoded, err = EncodeRecord(record, c.codec, c.compression)
+				if err != nil {
+					b.Fatalf("EncodeRecord: %v", err)
+				}
+			}
+			b.ReportMetric(float64(len(encoded)), "bytes/op")
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// finalFlushTimeout bounds how long RunPurgers will wait for the final,
+// post-shutdown PurgeCache pass across all purgers before giving up.
+const finalFlushTimeout = 10 * time.Second
+
+// RunPurgers starts every purger's StartPurgeLoop in its own goroutine and
+// blocks until the process receives SIGINT, SIGTERM or SIGHUP. On signal it
+// cancels the shared context, waits for every loop to return, then runs one
+// final PurgeCache per purger (bounded by finalFlushTimeout) so records
+// buffered in Redis between ticks aren't lost when Tyk is killed. Purgers
+// that implement Closer are closed once their final flush has completed.
+func RunPurgers(purgers []Purger, interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	var wg sync.WaitGroup
+	for _, p := range purgers {
+		wg.Add(1)
+		go func(p Purger) {
+			defer wg.Done()
+			p.StartPurgeLoop(ctx, interval)
+		}(p)
+	}
+
+	<-sigChan
+	log.Info("Shutdown signal received, draining analytics purgers...")
+	cancel()
+	wg.Wait()
+
+	finalFlush(purgers)
+}
+
+// finalFlush runs one last PurgeCache (and Close, where applicable) per
+// purger, giving up after finalFlushTimeout so a stuck backend can't hang
+// shutdown forever.
+func finalFlush(purgers []Purger) {
+	done := make(chan struct{})
+
+	go func() {
+		for _, p := range purgers {
+			p.PurgeCache()
+
+			if closer, ok := p.(Closer); ok {
+				if err := closer.Close(); err != nil {
+					log.Error("Error closing purger during shutdown:")
+					log.Error(err)
+				}
+			}
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Info("Final analytics flush complete")
+	case <-time.After(finalFlushTimeout):
+		log.Error("Final analytics flush timed out")
+	}
+}
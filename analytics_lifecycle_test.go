@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakePurger is a Purger test double that counts PurgeCache calls and
+// records whether its StartPurgeLoop observed ctx cancellation and whether
+// Close was called.
+type fakePurger struct {
+	purges int32
+
+	mu     sync.Mutex
+	closed bool
+
+	loopReturned chan struct{}
+}
+
+func newFakePurger() *fakePurger {
+	return &fakePurger{loopReturned: make(chan struct{})}
+}
+
+func (f *fakePurger) PurgeCache() {
+	atomic.AddInt32(&f.purges, 1)
+}
+
+func (f *fakePurger) StartPurgeLoop(ctx context.Context, interval time.Duration) {
+	<-ctx.Done()
+	close(f.loopReturned)
+}
+
+func (f *fakePurger) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+func (f *fakePurger) wasClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+// TestRunPurgersDrainsOnSignal sends SIGTERM to the running process and
+// asserts that RunPurgers cancels every purger's loop, runs exactly one
+// final PurgeCache, and closes any Closer purgers before returning.
+func TestRunPurgersDrainsOnSignal(t *testing.T) {
+	fp := newFakePurger()
+
+	runReturned := make(chan struct{})
+	go func() {
+		RunPurgers([]Purger{fp}, time.Hour)
+		close(runReturned)
+	}()
+
+	// Give RunPurgers a moment to call signal.Notify before we signal
+	// shutdown; a SIGTERM sent before then would kill the test process.
+	time.Sleep(50 * time.Millisecond)
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("failed to signal process: %v", err)
+	}
+
+	select {
+	case <-runReturned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunPurgers did not return after SIGTERM")
+	}
+
+	select {
+	case <-fp.loopReturned:
+	default:
+		t.Fatal("StartPurgeLoop did not observe context cancellation before RunPurgers returned")
+	}
+
+	if got := atomic.LoadInt32(&fp.purges); got != 1 {
+		t.Fatalf("expected exactly one final PurgeCache call, got %d", got)
+	}
+
+	if !fp.wasClosed() {
+		t.Fatal("expected purger to be closed after the final flush")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+)
+
+// RoutePatternResolver resolves a concrete request path against an API's
+// registered route patterns, returning the templated form (e.g. "/users/42"
+// becomes "/users/{id}"). No type in this package implements it; a caller
+// supplies one through the handlers' PathResolver field. Analytics only
+// depends on this narrow interface so it doesn't need to import routing
+// internals.
+type RoutePatternResolver interface {
+	ResolvePathTemplate(apiId, path string) string
+}
+
+// NormalizeConfig controls how an AnalyticsRecord is scrubbed before it is
+// encoded and handed to the storage backend. The zero value disables
+// normalization entirely, matching pre-existing behaviour.
+type NormalizeConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// QueryParamAllowlist, if non-empty, keeps only the named query
+	// params and drops every other one. Takes priority over
+	// QueryParamDenylist when both are set.
+	QueryParamAllowlist []string `json:"query_param_allowlist"`
+
+	// QueryParamDenylist strips the named query params (e.g. "token",
+	// "api_key") and keeps the rest, re-encoded in key order.
+	QueryParamDenylist []string `json:"query_param_denylist"`
+
+	// TruncateUserAgent caps UserAgent to this many bytes. Zero disables
+	// truncation.
+	TruncateUserAgent int `json:"truncate_user_agent"`
+
+	// HashAPIKey replaces APIKey with a salted SHA256 hash instead of
+	// storing it verbatim.
+	HashAPIKey bool   `json:"hash_api_key"`
+	HashSalt   string `json:"hash_salt"`
+}
+
+// normalizeConfigFor resolves the effective NormalizeConfig for apiId,
+// falling back to the global default when no per-API override is
+// configured.
+func normalizeConfigFor(apiId string) NormalizeConfig {
+	if override, ok := config.AnalyticsConfig.Normalize.PerAPI[apiId]; ok {
+		return override
+	}
+	return config.AnalyticsConfig.Normalize.Default
+}
+
+// normalizeRecord applies path templating and PII scrubbing to record ahead
+// of encoding, so every downstream sink benefits uniformly. resolver may be
+// nil, in which case the path is left as the router received it.
+func normalizeRecord(record AnalyticsRecord, cfg NormalizeConfig, resolver RoutePatternResolver) AnalyticsRecord {
+	if !cfg.Enabled {
+		return record
+	}
+
+	path := record.Path
+	if resolver != nil {
+		path = resolver.ResolvePathTemplate(record.ApiId, path)
+	}
+	record.Path = scrubQueryParams(path, cfg.QueryParamAllowlist, cfg.QueryParamDenylist)
+
+	if cfg.TruncateUserAgent > 0 && len(record.UserAgent) > cfg.TruncateUserAgent {
+		record.UserAgent = record.UserAgent[:cfg.TruncateUserAgent]
+	}
+
+	if cfg.HashAPIKey && record.APIKey != "" {
+		record.APIKey = hashWithSalt(record.APIKey, cfg.HashSalt)
+	}
+
+	return record
+}
+
+// scrubQueryParams rewrites the query string portion of path (if any)
+// according to allowlist/denylist rules. An allowlist, if non-empty, wins:
+// only the named params survive. Otherwise every denylisted param is
+// stripped and the rest are kept. The surviving params are re-encoded in key
+// order; a query string that fails to parse is dropped whole.
+func scrubQueryParams(path string, allowlist, denylist []string) string {
+	parts := strings.SplitN(path, "?", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return path
+	}
+	base, rawQuery := parts[0], parts[1]
+
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return base
+	}
+
+	if len(allowlist) > 0 {
+		allowed := make(map[string]bool, len(allowlist))
+		for _, k := range allowlist {
+			allowed[k] = true
+		}
+		for k := range values {
+			if !allowed[k] {
+				values.Del(k)
+			}
+		}
+	} else {
+		for _, k := range denylist {
+			values.Del(k)
+		}
+	}
+
+	if len(values) == 0 {
+		return base
+	}
+
+	return base + "?" + values.Encode()
+}
+
+// hashWithSalt returns the hex-encoded SHA256 hash of salt+value, used to
+// redact sensitive fields like APIKey while keeping them joinable across
+// records for the same key.
+func hashWithSalt(value, salt string) string {
+	sum := sha256.Sum256([]byte(salt + value))
+	return hex.EncodeToString(sum[:])
+}
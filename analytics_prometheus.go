@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// prometheusPathOverflowBucket is the label value used for any new path seen
+// after an API has already hit its configured path cardinality limit. Paths
+// tracked before the limit was reached keep their own label.
+const prometheusPathOverflowBucket = "+other"
+
+// defaultPrometheusMaxPathsPerAPI is used when PrometheusConfig.MaxPathsPerAPI
+// is left at its zero value.
+const defaultPrometheusMaxPathsPerAPI = 500
+
+// PrometheusAnalyticsHandler implements AnalyticsHandler and exposes hit
+// counters and response size histograms over a pull-based /metrics endpoint,
+// so operators can plug Tyk into a standard monitoring stack without writing
+// every single hit into Redis.
+type PrometheusAnalyticsHandler struct {
+	Registry *prometheus.Registry
+
+	hitCounter    *prometheus.CounterVec
+	contentLength *prometheus.HistogramVec
+
+	maxPathsPerAPI int
+	seenPathsMu    sync.Mutex
+	seenPaths      map[string]map[string]bool
+
+	// PathResolver, if set, is used to collapse a request path down to its
+	// registered route template before it becomes a metric label.
+	PathResolver RoutePatternResolver
+}
+
+// NewPrometheusAnalyticsHandler builds a PrometheusAnalyticsHandler with its
+// own registry, so it can be enabled alongside RedisAnalyticsHandler without
+// fighting over the default global Prometheus registry.
+func NewPrometheusAnalyticsHandler() *PrometheusAnalyticsHandler {
+	registry := prometheus.NewRegistry()
+
+	hitCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tyk_http_requests_total",
+		Help: "Total number of requests processed by Tyk, labelled by API and response code",
+	}, []string{"method", "path", "api_name", "api_version", "api_id", "org_id", "response_code"})
+
+	contentLength := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tyk_http_response_size_bytes",
+		Help:    "Distribution of response ContentLength, labelled by API",
+		Buckets: prometheus.ExponentialBuckets(100, 10, 7),
+	}, []string{"api_name", "api_version", "api_id"})
+
+	registry.MustRegister(hitCounter)
+	registry.MustRegister(contentLength)
+
+	maxPaths := config.AnalyticsConfig.PrometheusConfig.MaxPathsPerAPI
+	if maxPaths <= 0 {
+		maxPaths = defaultPrometheusMaxPathsPerAPI
+	}
+
+	return &PrometheusAnalyticsHandler{
+		Registry:       registry,
+		hitCounter:     hitCounter,
+		contentLength:  contentLength,
+		maxPathsPerAPI: maxPaths,
+		seenPaths:      make(map[string]map[string]bool),
+	}
+}
+
+// RecordHit updates the request counter and the ContentLength histogram for
+// a single AnalyticsRecord.
+func (p *PrometheusAnalyticsHandler) RecordHit(thisRecord AnalyticsRecord) error {
+	thisRecord = normalizeRecord(thisRecord, normalizeConfigFor(thisRecord.ApiId), p.PathResolver)
+
+	path := p.boundedPath(thisRecord.ApiId, thisRecord.Path)
+
+	p.hitCounter.WithLabelValues(
+		thisRecord.Method,
+		path,
+		thisRecord.APIName,
+		thisRecord.APIVersion,
+		thisRecord.ApiId,
+		thisRecord.OrgId,
+		strconv.Itoa(thisRecord.ResponseCode),
+	).Inc()
+
+	p.contentLength.WithLabelValues(
+		thisRecord.APIName,
+		thisRecord.APIVersion,
+		thisRecord.ApiId,
+	).Observe(float64(thisRecord.ContentLength))
+
+	return nil
+}
+
+// boundedPath enforces the per-API path cardinality guard: once maxPathsPerAPI
+// distinct paths have been observed for an API, any further new path is
+// folded into prometheusPathOverflowBucket instead of growing the label set.
+// RecordHit is called concurrently from request goroutines, so access to
+// seenPaths is serialized with seenPathsMu.
+func (p *PrometheusAnalyticsHandler) boundedPath(apiId, path string) string {
+	p.seenPathsMu.Lock()
+	defer p.seenPathsMu.Unlock()
+
+	seen, ok := p.seenPaths[apiId]
+	if !ok {
+		seen = make(map[string]bool)
+		p.seenPaths[apiId] = seen
+	}
+
+	if seen[path] {
+		return path
+	}
+
+	if len(seen) >= p.maxPathsPerAPI {
+		return prometheusPathOverflowBucket
+	}
+
+	seen[path] = true
+	return path
+}
+
+// Handler returns the http.Handler that serves this handler's registry in the
+// Prometheus text exposition format, ready to be mounted at /metrics.
+func (p *PrometheusAnalyticsHandler) Handler() http.Handler {
+	return promhttp.HandlerFor(p.Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nu7hatch/gouuid"
+	"labix.org/v2/mgo"
+)
+
+// deadLetterKeyPrefix namespaces the Redis keys used to hold records that a
+// sink failed to write even after exhausting its retries, so PurgeCache never
+// silently drops data.
+const deadLetterKeyPrefix = "analytics-deadletter-"
+
+// AnalyticsSink is a destination that a batch of AnalyticsRecords can be
+// fanned out to from the shared Redis buffer. Each sink owns its own batch
+// size and retry policy, so one backend failing doesn't stop records from
+// reaching the others. Sinks are written one after another, so a slow sink,
+// or one sleeping between retries, delays the sinks after it.
+type AnalyticsSink interface {
+	Name() string
+	BatchSize() int
+	MaxRetries() int
+	WriteBatch([]AnalyticsRecord) error
+}
+
+// MultiPurger is a Purger that drains the shared Redis analytics buffer once
+// per tick and fans the resulting records out to every registered
+// AnalyticsSink, so a single deployment can ship analytics into a TSDB, a
+// search backend and a SQL database at the same time.
+type MultiPurger struct {
+	Store *RedisStorageManager
+	Sinks []AnalyticsSink
+
+	// DeadLetterStore holds records a sink failed to write even after
+	// exhausting its retries. It must point at a keyspace PurgeCache's own
+	// GetKeysAndValues scan doesn't cover (a separate Redis DB/connection
+	// from Store) so dead-lettered records are never re-drained and
+	// re-fanned out to every sink on the next tick. If left nil, records
+	// that exhaust their retries are logged and dropped rather than risking
+	// that reprocessing loop.
+	DeadLetterStore *RedisStorageManager
+}
+
+// StartPurgeLoop runs PurgeCache every interval until ctx is cancelled.
+func (m *MultiPurger) StartPurgeLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.PurgeCache()
+		}
+	}
+}
+
+// PurgeCache pulls all buffered records out of Redis and writes them to every
+// registered sink, batched per-sink, before deleting the drained keys.
+func (m *MultiPurger) PurgeCache() {
+	KeyValueMap := m.Store.GetKeysAndValues()
+	if len(KeyValueMap) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(KeyValueMap))
+	records := make([]AnalyticsRecord, 0, len(KeyValueMap))
+
+	for k, v := range KeyValueMap {
+		keys = append(keys, k)
+		decoded, err := DecodeRecord([]byte(v))
+		if err != nil {
+			log.Error("Couldn't decode analytics data:")
+			log.Error(err)
+			continue
+		}
+		records = append(records, decoded)
+	}
+
+	for _, sink := range m.Sinks {
+		writeBatchesWithRetry(m.DeadLetterStore, sink, records)
+	}
+
+	m.Store.DeleteKeys(keys)
+}
+
+// writeBatchesWithRetry splits records into sink.BatchSize() chunks and hands
+// each chunk to the sink, retrying with exponential backoff. Chunks that are
+// still failing once MaxRetries() is exhausted are dead-lettered into
+// deadLetterStore, or logged and dropped when deadLetterStore is nil.
+// deadLetterStore is the keyspace PurgeCache's own scan excludes; see
+// MultiPurger.DeadLetterStore.
+func writeBatchesWithRetry(deadLetterStore *RedisStorageManager, sink AnalyticsSink, records []AnalyticsRecord) {
+	batchSize := sink.BatchSize()
+	if batchSize <= 0 {
+		batchSize = len(records)
+	}
+
+	for start := 0; start < len(records); start += batchSize {
+		end := start + batchSize
+		if end > len(records) {
+			end = len(records)
+		}
+		writeBatchWithRetry(deadLetterStore, sink, records[start:end])
+	}
+}
+
+func writeBatchWithRetry(deadLetterStore *RedisStorageManager, sink AnalyticsSink, batch []AnalyticsRecord) {
+	if len(batch) == 0 {
+		return
+	}
+
+	maxRetries := sink.MaxRetries()
+	backoff := 500 * time.Millisecond
+
+	var err error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if err = sink.WriteBatch(batch); err == nil {
+			return
+		}
+
+		log.Error(fmt.Sprintf("Sink %s failed to write batch (attempt %d/%d):", sink.Name(), attempt+1, maxRetries+1))
+		log.Error(err)
+
+		if attempt < maxRetries {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	if deadLetterStore == nil {
+		log.Error(fmt.Sprintf("No DeadLetterStore configured, dropping %d records that sink %s could not write", len(batch), sink.Name()))
+		return
+	}
+
+	deadLetterBatch(deadLetterStore, sink.Name(), batch)
+}
+
+// deadLetterBatch encodes each record in batch into deadLetterStore, a
+// keyspace distinct from the one MultiPurger.PurgeCache drains, so a
+// persistently-failing sink's dead letters are never re-scanned and
+// re-fanned out to every sink (including ones that already succeeded) on
+// the next tick.
+func deadLetterBatch(deadLetterStore *RedisStorageManager, sinkName string, batch []AnalyticsRecord) {
+	for _, record := range batch {
+		encoded, err := EncodeRecord(record, MsgpackCodec{}, codecCompressionNone)
+		if err != nil {
+			log.Error("Couldn't encode dead-lettered analytics record:")
+			log.Error(err)
+			continue
+		}
+
+		u5, _ := uuid.NewV4()
+		keyName := fmt.Sprintf("%s%s-%d%d%d%d-%s", deadLetterKeyPrefix, sinkName, record.Year, record.Month, record.Day, record.Hour, u5.String())
+		deadLetterStore.SetKey(keyName, string(encoded), 0)
+	}
+}
+
+// sinkBatching is embedded by concrete sinks to carry the shared batch size
+// and retry count fields, since every sink config block looks the same.
+type sinkBatching struct {
+	batchSize  int
+	maxRetries int
+}
+
+func (s sinkBatching) BatchSize() int  { return s.batchSize }
+func (s sinkBatching) MaxRetries() int { return s.maxRetries }
+
+// InfluxDBSink writes batches of AnalyticsRecords to InfluxDB using the line
+// protocol over HTTP, one point per record on the "tyk_analytics"
+// measurement.
+type InfluxDBSink struct {
+	sinkBatching
+	URL      string
+	Database string
+	Client   *http.Client
+}
+
+// NewInfluxDBSink builds an InfluxDBSink that writes into database on the
+// InfluxDB server at url.
+func NewInfluxDBSink(url, database string, batchSize, maxRetries int) *InfluxDBSink {
+	return &InfluxDBSink{
+		sinkBatching: sinkBatching{batchSize: batchSize, maxRetries: maxRetries},
+		URL:          url,
+		Database:     database,
+		Client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (i *InfluxDBSink) Name() string { return "influxdb" }
+
+// WriteBatch encodes records as InfluxDB line protocol and posts them to the
+// write endpoint of i.Database in a single request.
+func (i *InfluxDBSink) WriteBatch(records []AnalyticsRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, r := range records {
+		writeInfluxLine(&buf, r)
+	}
+
+	req, err := http.NewRequest("POST", i.URL+"/write?db="+i.Database, &buf)
+	if err != nil {
+		return err
+	}
+
+	resp, err := i.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("influxdb write failed with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// writeInfluxLine appends the line-protocol representation of r to buf.
+// Empty tag values are omitted (InfluxDB rejects "tag=") and tag values are
+// escaped per the line protocol spec, since commas, spaces and equals signs
+// are otherwise read as field/tag separators and would produce a malformed
+// line that gets the whole batch rejected.
+func writeInfluxLine(buf *bytes.Buffer, r AnalyticsRecord) {
+	buf.WriteString("tyk_analytics")
+	writeInfluxTag(buf, "api_id", r.ApiId)
+	writeInfluxTag(buf, "api_name", r.APIName)
+	writeInfluxTag(buf, "api_version", r.APIVersion)
+	writeInfluxTag(buf, "org_id", r.OrgId)
+	writeInfluxTag(buf, "response_code", strconv.Itoa(r.ResponseCode))
+
+	fmt.Fprintf(buf, " method=%q,path=%q,content_length=%di %d\n",
+		r.Method, r.Path, r.ContentLength, r.TimeStamp.UnixNano())
+}
+
+// writeInfluxTag appends ",key=value" to buf with value escaped, or nothing
+// at all if value is empty.
+func writeInfluxTag(buf *bytes.Buffer, key, value string) {
+	if value == "" {
+		return
+	}
+	buf.WriteByte(',')
+	buf.WriteString(key)
+	buf.WriteByte('=')
+	buf.WriteString(escapeInfluxTagValue(value))
+}
+
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// escapeInfluxTagValue escapes the characters InfluxDB line protocol treats
+// as tag-value delimiters: commas, equals signs and spaces.
+func escapeInfluxTagValue(v string) string {
+	return influxTagEscaper.Replace(v)
+}
+
+// ElasticsearchSink writes batches of AnalyticsRecords to Elasticsearch using
+// the bulk API, rolling a new index per day (tyk-analytics-YYYY.MM.DD).
+type ElasticsearchSink struct {
+	sinkBatching
+	URL    string
+	Client *http.Client
+}
+
+// NewElasticsearchSink builds an ElasticsearchSink pointed at the given
+// cluster URL.
+func NewElasticsearchSink(url string, batchSize, maxRetries int) *ElasticsearchSink {
+	return &ElasticsearchSink{
+		sinkBatching: sinkBatching{batchSize: batchSize, maxRetries: maxRetries},
+		URL:          url,
+		Client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e *ElasticsearchSink) Name() string { return "elasticsearch" }
+
+// indexName returns the daily-rolled index name a record belongs in.
+func indexName(r AnalyticsRecord) string {
+	return fmt.Sprintf("tyk-analytics-%04d.%02d.%02d", r.Year, r.Month, r.Day)
+}
+
+// WriteBatch posts records to Elasticsearch's _bulk endpoint, one index
+// action per record, targeting the index for that record's day.
+func (e *ElasticsearchSink) WriteBatch(records []AnalyticsRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, r := range records {
+		action := map[string]interface{}{
+			"index": map[string]string{"_index": indexName(r), "_type": "analytics"},
+		}
+		actionLine, err := json.Marshal(action)
+		if err != nil {
+			return err
+		}
+		recordLine, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		buf.Write(actionLine)
+		buf.WriteByte('\n')
+		buf.Write(recordLine)
+		buf.WriteByte('\n')
+	}
+
+	req, err := http.NewRequest("POST", e.URL+"/_bulk", &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("elasticsearch bulk write failed with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// PostgresSink writes batches of AnalyticsRecords to a Postgres table using a
+// single batched INSERT per call.
+type PostgresSink struct {
+	sinkBatching
+	DB    *sql.DB
+	Table string
+}
+
+// NewPostgresSink builds a PostgresSink writing into the given table.
+func NewPostgresSink(db *sql.DB, table string, batchSize, maxRetries int) *PostgresSink {
+	return &PostgresSink{
+		sinkBatching: sinkBatching{batchSize: batchSize, maxRetries: maxRetries},
+		DB:           db,
+		Table:        table,
+	}
+}
+
+func (p *PostgresSink) Name() string { return "postgres" }
+
+// WriteBatch builds a single "INSERT ... VALUES (...), (...), ..." statement
+// for the whole batch and executes it.
+func (p *PostgresSink) WriteBatch(records []AnalyticsRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	query := fmt.Sprintf(`INSERT INTO %s
+		(method, path, content_length, user_agent, day, month, year, hour,
+		 response_code, api_key, time_stamp, api_version, api_name, api_id, org_id)
+		VALUES `, p.Table)
+
+	args := make([]interface{}, 0, len(records)*15)
+	for i, r := range records {
+		if i > 0 {
+			query += ", "
+		}
+		base := i * 15
+		placeholders := ""
+		for j := 1; j <= 15; j++ {
+			if j > 1 {
+				placeholders += ", "
+			}
+			placeholders += "$" + strconv.Itoa(base+j)
+		}
+		query += "(" + placeholders + ")"
+
+		args = append(args,
+			r.Method, r.Path, r.ContentLength, r.UserAgent, r.Day, int(r.Month), r.Year, r.Hour,
+			r.ResponseCode, r.APIKey, r.TimeStamp, r.APIVersion, r.APIName, r.ApiId, r.OrgId)
+	}
+
+	_, err := p.DB.Exec(query, args...)
+	return err
+}
+
+// CSVSink adapts CSVPurger's file-writing logic to the AnalyticsSink
+// interface so it can be plugged into a MultiPurger alongside the other
+// sinks.
+type CSVSink struct {
+	sinkBatching
+	Dir string
+}
+
+// NewCSVSink builds a CSVSink writing timestamped files into dir.
+func NewCSVSink(dir string, batchSize, maxRetries int) *CSVSink {
+	return &CSVSink{sinkBatching: sinkBatching{batchSize: batchSize, maxRetries: maxRetries}, Dir: dir}
+}
+
+func (c *CSVSink) Name() string { return "csv" }
+
+// WriteBatch writes records to a new timestamped CSV file under c.Dir.
+func (c *CSVSink) WriteBatch(records []AnalyticsRecord) error {
+	return writeCSVFile(c.Dir, records)
+}
+
+// MongoSink adapts MongoPurger's insert logic to the AnalyticsSink interface.
+type MongoSink struct {
+	sinkBatching
+	Session    *mgo.Session
+	Collection string
+}
+
+func (m *MongoSink) Name() string { return "mongo" }
+
+// WriteBatch inserts records into m.Collection.
+func (m *MongoSink) WriteBatch(records []AnalyticsRecord) error {
+	return insertMongoRecords(m.Session, m.Collection, records)
+}
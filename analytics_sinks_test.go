@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWriteInfluxLine_EscapesTagsAndDropsEmpty proves that an API name
+// containing a space, and an empty OrgId, don't produce a line with
+// unescaped delimiters or a dangling empty tag value.
+func TestWriteInfluxLine_EscapesTagsAndDropsEmpty(t *testing.T) {
+	r := AnalyticsRecord{
+		Method:       "GET",
+		Path:         "/users/42",
+		ApiId:        "api-1",
+		APIName:      "My API",
+		APIVersion:   "v1",
+		OrgId:        "",
+		ResponseCode: 200,
+		TimeStamp:    time.Unix(1700000000, 0),
+	}
+
+	var buf bytes.Buffer
+	writeInfluxLine(&buf, r)
+	line := buf.String()
+
+	if strings.Contains(line, "api_name=My API") {
+		t.Fatalf("expected space in tag value to be escaped, got: %s", line)
+	}
+	if !strings.Contains(line, `api_name=My\ API`) {
+		t.Fatalf("expected escaped api_name tag, got: %s", line)
+	}
+	if strings.Contains(line, "org_id=") {
+		t.Fatalf("expected empty org_id tag to be dropped, got: %s", line)
+	}
+
+	tags, fields := splitUnescapedSpace(line)
+	if strings.Count(tags, "=") != strings.Count(tags, ",") {
+		t.Fatalf("tag set looks malformed: %s", tags)
+	}
+	if !strings.HasPrefix(fields, "method=") {
+		t.Fatalf("expected fields to start after the unescaped tags/fields separator, got: %s", line)
+	}
+}
+
+// splitUnescapedSpace splits line-protocol text on the first space that
+// isn't escaped with a backslash, which is how line protocol itself
+// separates the tag set from the field set. A naive strings.SplitN(line, "
+// ", 2) would instead split inside an escaped tag value like "My\ API".
+func splitUnescapedSpace(line string) (before, after string) {
+	for i := 0; i < len(line); i++ {
+		if line[i] == ' ' && (i == 0 || line[i-1] != '\\') {
+			return line[:i], line[i+1:]
+		}
+	}
+	return line, ""
+}
@@ -0,0 +1,46 @@
+package main
+
+// AnalyticsConfigConfig holds the analytics-related settings read from the
+// gateway's JSON config file, under the "analytics_config" key.
+type AnalyticsConfigConfig struct {
+	CSVDir          string `json:"csv_dir"`
+	MongoURL        string `json:"mongo_url"`
+	MongoCollection string `json:"mongo_collection"`
+
+	// PrometheusConfig controls the optional Prometheus /metrics exporter.
+	PrometheusConfig PrometheusConfig `json:"prometheus_config"`
+
+	// Normalize controls path templating and PII scrubbing applied before
+	// RecordHit encodes a record.
+	Normalize NormalizeSettings `json:"normalize"`
+
+	// Serializer selects the RecordCodec and compression RecordHit encodes
+	// with, e.g. "msgpack", "protobuf" or "protobuf+lz4". Empty means
+	// msgpack with no compression. See NewRecordCodecFromConfig.
+	Serializer string `json:"serializer"`
+}
+
+// NormalizeSettings holds the global default NormalizeConfig plus any
+// per-API overrides, keyed by ApiId.
+type NormalizeSettings struct {
+	Default NormalizeConfig            `json:"default"`
+	PerAPI  map[string]NormalizeConfig `json:"per_api"`
+}
+
+// PrometheusConfig controls PrometheusAnalyticsHandler's path cardinality
+// guard.
+type PrometheusConfig struct {
+	// MaxPathsPerAPI caps how many distinct paths are tracked per API
+	// before further new paths are folded into the overflow bucket. Zero
+	// falls back to defaultPrometheusMaxPathsPerAPI.
+	MaxPathsPerAPI int `json:"max_paths_per_api"`
+}
+
+// Config is the top-level gateway configuration.
+type Config struct {
+	AnalyticsConfig AnalyticsConfigConfig `json:"analytics_config"`
+}
+
+// config is the global, process-wide gateway configuration, populated at
+// startup from the JSON config file.
+var config Config
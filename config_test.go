@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// TestAnalyticsConfigConfig_JSONRoundTrip proves the analytics_config JSON
+// shape documented in the various analytics requests (prometheus_config,
+// serializer, ...) actually unmarshals into the fields the analytics code
+// reads off the global config.
+func TestAnalyticsConfigConfig_JSONRoundTrip(t *testing.T) {
+	raw := []byte(`{
+		"analytics_config": {
+			"csv_dir": "/var/log/tyk/analytics",
+			"mongo_url": "mongodb://localhost/tyk",
+			"mongo_collection": "tyk_analytics",
+			"prometheus_config": {
+				"max_paths_per_api": 250
+			},
+			"serializer": "protobuf+lz4"
+		}
+	}`)
+
+	var cfg Config
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+
+	if cfg.AnalyticsConfig.CSVDir != "/var/log/tyk/analytics" {
+		t.Errorf("CSVDir = %q", cfg.AnalyticsConfig.CSVDir)
+	}
+	if cfg.AnalyticsConfig.PrometheusConfig.MaxPathsPerAPI != 250 {
+		t.Errorf("PrometheusConfig.MaxPathsPerAPI = %d, want 250", cfg.AnalyticsConfig.PrometheusConfig.MaxPathsPerAPI)
+	}
+	if cfg.AnalyticsConfig.Serializer != "protobuf+lz4" {
+		t.Errorf("Serializer = %q, want %q", cfg.AnalyticsConfig.Serializer, "protobuf+lz4")
+	}
+
+	encoded, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+
+	var roundTripped Config
+	if err := json.Unmarshal(encoded, &roundTripped); err != nil {
+		t.Fatalf("json.Unmarshal(round trip): %v", err)
+	}
+
+	if !reflect.DeepEqual(roundTripped, cfg) {
+		t.Fatalf("round trip mismatch: got %+v, want %+v", roundTripped, cfg)
+	}
+}
+
+// TestAnalyticsConfigConfig_NormalizeJSONRoundTrip proves the
+// analytics_config.normalize block, including a per-API override, round
+// trips through JSON into the fields normalizeConfigFor reads.
+func TestAnalyticsConfigConfig_NormalizeJSONRoundTrip(t *testing.T) {
+	raw := []byte(`{
+		"analytics_config": {
+			"normalize": {
+				"default": {
+					"enabled": true,
+					"query_param_denylist": ["token", "api_key"],
+					"truncate_user_agent": 128,
+					"hash_api_key": true,
+					"hash_salt": "pepper"
+				},
+				"per_api": {
+					"api-1": {
+						"enabled": true,
+						"query_param_allowlist": ["page"]
+					}
+				}
+			}
+		}
+	}`)
+
+	var cfg Config
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+
+	def := cfg.AnalyticsConfig.Normalize.Default
+	if !def.Enabled || !def.HashAPIKey || def.HashSalt != "pepper" || def.TruncateUserAgent != 128 {
+		t.Fatalf("unexpected default normalize config: %+v", def)
+	}
+
+	override, ok := cfg.AnalyticsConfig.Normalize.PerAPI["api-1"]
+	if !ok {
+		t.Fatalf("expected a per-API override for api-1, got %+v", cfg.AnalyticsConfig.Normalize.PerAPI)
+	}
+	if len(override.QueryParamAllowlist) != 1 || override.QueryParamAllowlist[0] != "page" {
+		t.Fatalf("unexpected per-API override: %+v", override)
+	}
+
+	encoded, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+
+	var roundTripped Config
+	if err := json.Unmarshal(encoded, &roundTripped); err != nil {
+		t.Fatalf("json.Unmarshal(round trip): %v", err)
+	}
+
+	if !reflect.DeepEqual(roundTripped, cfg) {
+		t.Fatalf("round trip mismatch: got %+v, want %+v", roundTripped, cfg)
+	}
+}